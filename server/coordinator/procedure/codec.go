@@ -0,0 +1,78 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+)
+
+// frameMagic marks a value as framed (header + compressed/encoded body)
+// rather than legacy plain JSON. It's chosen to never collide with the first
+// byte of a JSON document, which is always '{' (0x7b) for a Meta value.
+const frameMagic = 0xff
+
+// CompressionType selects the codec used to compress a Meta payload before
+// it's written to etcd. The zero value, CompressionNone, disables
+// compression, so values are written as plain versioned bytes (see
+// encodeMeta) with no frame header.
+type CompressionType byte
+
+const (
+	CompressionNone CompressionType = iota
+	CompressionGzip
+	CompressionSnappy
+)
+
+func compress(codec CompressionType, data []byte) ([]byte, error) {
+	switch codec {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	default:
+		return nil, errors.Errorf("unsupported compression codec: %d", codec)
+	}
+}
+
+func decompress(codec CompressionType, data []byte) ([]byte, error) {
+	switch codec {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	case CompressionSnappy:
+		return snappy.Decode(nil, data)
+	default:
+		return nil, errors.Errorf("unsupported compression codec: %d", codec)
+	}
+}
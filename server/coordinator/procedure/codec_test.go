@@ -0,0 +1,45 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressDecompressRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("horaemeta-procedure-meta"), 64)
+
+	for _, codec := range []CompressionType{CompressionGzip, CompressionSnappy} {
+		compressed, err := compress(codec, payload)
+		require.NoError(t, err)
+
+		decompressed, err := decompress(codec, compressed)
+		require.NoError(t, err)
+		require.Equal(t, payload, decompressed)
+	}
+}
+
+func TestCompressUnsupportedCodec(t *testing.T) {
+	_, err := compress(CompressionNone, []byte("data"))
+	require.Error(t, err)
+
+	_, err = decompress(CompressionNone, []byte("data"))
+	require.Error(t, err)
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// ErrConcurrentUpdate is returned by CreateOrUpdate and MarkDeleted when the
+// compare-and-swap against Meta.ModRevision fails, i.e. some other writer
+// already advanced the procedure's state. Current holds the server-side Meta
+// as of the failed attempt, so the caller can decide whether to retry (after
+// re-validating against Current) or give up.
+type ErrConcurrentUpdate struct {
+	Current *Meta
+}
+
+func (e *ErrConcurrentUpdate) Error() string {
+	return fmt.Sprintf("concurrent update: procedureID:%d is no longer at the expected revision", e.Current.ID)
+}
+
+// Get fetches a single procedure's Meta, with ModRevision populated from the
+// current etcd key, so the result can be round-tripped straight into
+// CreateOrUpdate as an optimistic-concurrency token.
+func (e EtcdStorageImpl) Get(ctx context.Context, id uint64) (*Meta, error) {
+	keyPath := e.generaNormalKeyPath(id)
+	resp, err := e.client.Get(ctx, keyPath)
+	if err != nil {
+		return nil, errors.WithMessage(err, "get meta failed")
+	}
+	if len(resp.Kvs) == 0 {
+		keyPath = e.generateKeyPath(id, false, LegacyVersion)
+		resp, err = e.client.Get(ctx, keyPath)
+		if err != nil {
+			return nil, errors.WithMessage(err, "get meta failed")
+		}
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, errors.Errorf("procedure not found, procedureID:%d", id)
+	}
+
+	return decodeMetaKV(resp.Kvs[0])
+}
+
+// ForceCreateOrUpdate inserts meta as a brand new procedure, regardless of
+// whatever ModRevision it's carrying: the CAS always compares against the
+// key's create-revision being zero, so it fails if the procedure already
+// exists rather than silently overwriting it. Use CreateOrUpdate instead when
+// updating a procedure you've previously Get/List'd.
+func (e EtcdStorageImpl) ForceCreateOrUpdate(ctx context.Context, meta Meta) error {
+	meta.ModRevision = 0
+	return e.createOrUpdate(ctx, meta)
+}
+
+// CreateOrUpdate example:
+// /{rootPath}/v2/procedure/{clusterID}/{procedureID} -> {version byte} + {encoded Meta}, see encodeMeta
+//
+// The write is guarded by a compare-and-swap on meta.ModRevision: a zero
+// ModRevision (the zero value, e.g. a procedure built from scratch rather
+// than returned by Get/List) compares against the key's create-revision, so
+// it behaves like an insert-only create; a non-zero ModRevision compares
+// against the key's current mod-revision, so a stale caller - one racing
+// against another writer that already advanced the procedure - gets back
+// ErrConcurrentUpdate instead of silently clobbering the newer state.
+func (e EtcdStorageImpl) CreateOrUpdate(ctx context.Context, meta Meta) error {
+	return e.createOrUpdate(ctx, meta)
+}
+
+func (e EtcdStorageImpl) createOrUpdate(ctx context.Context, meta Meta) error {
+	s, err := e.encodeMeta(&meta)
+	if err != nil {
+		return errors.WithMessage(err, "encode meta failed")
+	}
+
+	// A procedure created before the v2 rollout still lives at its legacy v1
+	// key; update it in place there instead of forking a duplicate entry
+	// under v2. Only genuinely new procedure IDs land under Version.
+	keyPath, err := e.resolveKeyPath(ctx, meta.ID)
+	if err != nil {
+		return errors.WithMessage(err, "resolve key path failed")
+	}
+
+	var cmp clientv3.Cmp
+	if meta.ModRevision == 0 {
+		cmp = clientv3.Compare(clientv3.CreateRevision(keyPath), "=", 0)
+	} else {
+		cmp = clientv3.Compare(clientv3.ModRevision(keyPath), "=", meta.ModRevision)
+	}
+	opPut := clientv3.OpPut(keyPath, s)
+	opGet := clientv3.OpGet(keyPath)
+
+	txnResp, err := e.client.Txn(ctx).If(cmp).Then(opPut).Else(opGet).Commit()
+	if err != nil {
+		return errors.WithMessage(err, "etcd txn put data failed")
+	}
+	if txnResp.Succeeded {
+		return nil
+	}
+
+	rangeResp := (*clientv3.GetResponse)(txnResp.Responses[0].GetResponseRange())
+	current, err := decodeConcurrentUpdateCurrent(rangeResp, meta.ID)
+	if err != nil {
+		return errors.WithMessage(err, "decode current meta failed")
+	}
+	return &ErrConcurrentUpdate{Current: current}
+}
+
+// decodeConcurrentUpdateCurrent decodes the server-side Meta returned by a
+// failed CAS's Else(OpGet) branch. If the key no longer exists at all
+// (e.g. it was concurrently soft-deleted), it reports that as Current with a
+// zero ModRevision rather than erroring, since "the procedure is gone" is
+// itself useful information for the caller to act on.
+func decodeConcurrentUpdateCurrent(rangeResp *clientv3.GetResponse, procedureID uint64) (*Meta, error) {
+	if rangeResp == nil || len(rangeResp.Kvs) == 0 {
+		return &Meta{ID: procedureID}, nil
+	}
+	return decodeMetaKV(rangeResp.Kvs[0])
+}
+
+func decodeMetaKV(kv *mvccpb.KeyValue) (*Meta, error) {
+	meta, err := decodeMeta(string(kv.Value))
+	if err != nil {
+		return nil, errors.WithMessagef(err, "decode meta failed, key:%s", kv.Key)
+	}
+	meta.ModRevision = kv.ModRevision
+	return meta, nil
+}
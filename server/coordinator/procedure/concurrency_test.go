@@ -0,0 +1,102 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/tests/v3/integration"
+)
+
+// newTestStorage starts a single-member embedded etcd cluster for the
+// duration of t and returns a Storage backed by it. The cluster is torn down
+// via t.Cleanup, mirroring how the rest of this package's callers never have
+// to manage the underlying client's lifecycle themselves.
+func newTestStorage(t *testing.T) Storage {
+	t.Helper()
+	integration.BeforeTestExternal(t)
+
+	cluster := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	t.Cleanup(cluster.Terminate)
+
+	storage, _, _ := NewEtcdStorageImpl(cluster.RandClient(), "/horaemeta-test", 1, CompressionNone, 0, RetentionPolicy{}, 0)
+	return storage
+}
+
+func TestCreateOrUpdateCAS(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	meta := Meta{ID: 1, ClusterID: 1, Typ: "create-table", State: "running"}
+	require.NoError(t, storage.ForceCreateOrUpdate(ctx, meta))
+
+	got, err := storage.Get(ctx, meta.ID)
+	require.NoError(t, err)
+	require.Equal(t, meta.State, got.State)
+	require.NotZero(t, got.ModRevision)
+
+	// A write carrying the current ModRevision succeeds...
+	got.State = "success"
+	require.NoError(t, storage.CreateOrUpdate(ctx, *got))
+
+	// ...but replaying the now-stale Meta loses the race and gets back
+	// ErrConcurrentUpdate, with Current reflecting the write that won.
+	staleMeta := *got
+	staleMeta.State = "failed"
+	err = storage.CreateOrUpdate(ctx, staleMeta)
+	require.Error(t, err)
+
+	var concurrentErr *ErrConcurrentUpdate
+	require.ErrorAs(t, err, &concurrentErr)
+	require.Equal(t, "success", concurrentErr.Current.State)
+}
+
+// TestListPopulatesModRevision guards against List regressing to returning
+// ModRevision == 0, which would make every listed Meta fail its CAS against
+// CreateOrUpdate with a spurious ErrConcurrentUpdate (it would be compared as
+// an insert rather than an update).
+func TestListPopulatesModRevision(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	meta := Meta{ID: 3, ClusterID: 1, Typ: "create-table", State: "running"}
+	require.NoError(t, storage.ForceCreateOrUpdate(ctx, meta))
+
+	listed, err := storage.List(ctx, 100)
+	require.NoError(t, err)
+	require.Len(t, listed, 1)
+	require.NotZero(t, listed[0].ModRevision)
+
+	listed[0].State = "success"
+	require.NoError(t, storage.CreateOrUpdate(ctx, *listed[0]))
+}
+
+func TestForceCreateOrUpdateRejectsExisting(t *testing.T) {
+	storage := newTestStorage(t)
+	ctx := context.Background()
+
+	meta := Meta{ID: 2, ClusterID: 1, Typ: "create-table", State: "running"}
+	require.NoError(t, storage.ForceCreateOrUpdate(ctx, meta))
+
+	err := storage.ForceCreateOrUpdate(ctx, meta)
+	require.Error(t, err)
+
+	var concurrentErr *ErrConcurrentUpdate
+	require.ErrorAs(t, err, &concurrentErr)
+}
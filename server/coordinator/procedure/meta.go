@@ -0,0 +1,39 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+// Meta is the persisted representation of a single procedure; see meta.proto
+// for the wire schema it mirrors field-for-field.
+type Meta struct {
+	ID        uint64 `json:"id"`
+	ClusterID uint32 `json:"clusterId"`
+	Typ       string `json:"typ"`
+	State     string `json:"state"`
+	RaftIndex uint64 `json:"raftIndex"`
+	CreatedAt int64  `json:"createdAt"`
+	UpdatedAt int64  `json:"updatedAt"`
+	Data      []byte `json:"data"`
+
+	// ModRevision is the etcd mod-revision Meta was last read at. It's never
+	// persisted (Get/List populate it from the etcd response, not from the
+	// encoded payload), and it's the token CreateOrUpdate compares against to
+	// guard a write with optimistic concurrency control: pass back a Meta
+	// exactly as returned by Get/List to update in place, or leave it zero
+	// (the zero value) to insert a brand new procedure via
+	// ForceCreateOrUpdate.
+	ModRevision int64 `json:"-"`
+}
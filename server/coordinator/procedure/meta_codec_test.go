@@ -0,0 +1,75 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testMeta() *Meta {
+	return &Meta{
+		ID:        42,
+		ClusterID: 7,
+		Typ:       "create-table",
+		State:     "running",
+		RaftIndex: 100,
+		CreatedAt: 1000,
+		UpdatedAt: 2000,
+		Data:      []byte(`{"tableName":"t1"}`),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{JSONCodec{}, ProtoCodec{}} {
+		meta := testMeta()
+		body, err := codec.Encode(meta)
+		require.NoError(t, err)
+
+		decoded, err := codec.Decode(body)
+		require.NoError(t, err)
+		require.Equal(t, meta, decoded)
+	}
+}
+
+func TestCodecForVersion(t *testing.T) {
+	codec, err := codecForVersion(metaVersionJSON)
+	require.NoError(t, err)
+	require.Equal(t, JSONCodec{}, codec)
+
+	codec, err = codecForVersion(metaVersionProto)
+	require.NoError(t, err)
+	require.Equal(t, ProtoCodec{}, codec)
+
+	_, err = codecForVersion(0xee)
+	require.Error(t, err)
+}
+
+// TestProtoCodecOmitsZeroFields exercises the hand-rolled varint encoder's
+// zero-value skipping: a Meta with no raft index or timestamps set should
+// still round-trip to equal, not merely to a non-error.
+func TestProtoCodecOmitsZeroFields(t *testing.T) {
+	meta := &Meta{ID: 1, ClusterID: 1, Typ: "t", State: "s"}
+
+	body, err := ProtoCodec{}.Encode(meta)
+	require.NoError(t, err)
+
+	decoded, err := ProtoCodec{}.Decode(body)
+	require.NoError(t, err)
+	require.Equal(t, meta, decoded)
+}
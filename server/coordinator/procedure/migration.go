@@ -0,0 +1,143 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"context"
+	"math"
+
+	"github.com/CeresDB/horaemeta/server/etcdutil"
+	"github.com/pkg/errors"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// MigrationCompactor upgrades procedures still living under the legacy v1
+// path from plain JSON to newestCodec, in place, without relocating them to
+// the v2 path. It's meant to be run periodically (e.g. from a background
+// goroutine) during a rolling upgrade so that, over time, List stops paying
+// the cost of decoding legacy JSON values.
+type MigrationCompactor struct {
+	client    *clientv3.Client
+	clusterID uint32
+	rootPath  string
+
+	// compression and compressionThreshold mirror the EtcdStorageImpl this
+	// MigrationCompactor upgrades entries for, so a large legacy entry is
+	// compressed on upgrade exactly as CreateOrUpdate would have written it,
+	// rather than always landing uncompressed.
+	compression          CompressionType
+	compressionThreshold int
+}
+
+// NewMigrationCompactor creates a MigrationCompactor for the given cluster's
+// legacy v1 procedure entries. compression and compressionThreshold should
+// match the values passed to NewEtcdStorageImpl, so upgraded entries get the
+// same compression treatment as freshly written ones.
+func NewMigrationCompactor(client *clientv3.Client, rootPath string, clusterID uint32, compression CompressionType, compressionThreshold int) *MigrationCompactor {
+	if compressionThreshold <= 0 {
+		compressionThreshold = defaultCompressionThreshold
+	}
+	return &MigrationCompactor{
+		client:               client,
+		clusterID:            clusterID,
+		rootPath:             rootPath,
+		compression:          compression,
+		compressionThreshold: compressionThreshold,
+	}
+}
+
+// Compact scans the legacy v1 procedure prefix in batches of batchSize,
+// re-encoding every entry it can decode with newestCodec and committing the
+// upgrade through a transaction guarded by the entry's original mod-revision,
+// so a concurrent state-changing write from a scheduler worker is never
+// clobbered. Entries that fail the CAS are left for the next run.
+func (c *MigrationCompactor) Compact(ctx context.Context, batchSize int) error {
+	startKey := c.generaLegacyKeyPath(uint64(0))
+	endKey := c.generaLegacyKeyPath(math.MaxUint64)
+
+	var upgradeErr error
+	do := func(key string, value []byte) error {
+		if err := c.upgradeOne(ctx, key, value); err != nil {
+			// Keep scanning; a single bad entry shouldn't stall the whole
+			// compaction pass. The error is surfaced once Compact returns.
+			upgradeErr = errors.WithMessagef(err, "upgrade procedure failed, key:%s", key)
+			zap.L().Warn("migration compactor failed to upgrade entry", zap.String("key", key), zap.Error(err))
+		}
+		return nil
+	}
+
+	if err := etcdutil.Scan(ctx, c.client, startKey, endKey, batchSize, do); err != nil {
+		return errors.WithMessage(err, "scan legacy procedure failed")
+	}
+	return upgradeErr
+}
+
+func (c *MigrationCompactor) upgradeOne(ctx context.Context, key string, value []byte) error {
+	resp, err := c.client.Get(ctx, key)
+	if err != nil {
+		return errors.WithMessage(err, "get current revision failed")
+	}
+	if len(resp.Kvs) == 0 {
+		// Deleted or already moved under MarkDeleted between the scan and
+		// this read; nothing to upgrade.
+		return nil
+	}
+	// Decode the value this read returned rather than the scanned one, so the
+	// re-encoded payload always matches the mod-revision the CAS compares.
+	meta, err := decodeMeta(string(resp.Kvs[0].Value))
+	if err != nil {
+		return errors.WithMessage(err, "decode legacy meta failed")
+	}
+	modRevision := resp.Kvs[0].ModRevision
+
+	// Encode through the same path CreateOrUpdate uses, so an entry large
+	// enough to warrant compression gets upgraded to a compressed payload
+	// instead of an uncompressed one.
+	payload, err := c.storage().encodeMeta(meta)
+	if err != nil {
+		return errors.WithMessage(err, "encode meta failed")
+	}
+
+	txn := c.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(clientv3.OpPut(key, payload))
+	txnResp, err := txn.Commit()
+	if err != nil {
+		return errors.WithMessage(err, "commit upgrade failed")
+	}
+	if !txnResp.Succeeded {
+		// Lost the race to a concurrent state-changing write; the next
+		// compaction pass will pick this entry up again.
+		return nil
+	}
+	return nil
+}
+
+func (c *MigrationCompactor) generaLegacyKeyPath(procedureID uint64) string {
+	return c.storage().generateKeyPath(procedureID, false, LegacyVersion)
+}
+
+func (c *MigrationCompactor) storage() EtcdStorageImpl {
+	return EtcdStorageImpl{
+		client:               c.client,
+		clusterID:            c.clusterID,
+		rootPath:             c.rootPath,
+		compression:          c.compression,
+		compressionThreshold: c.compressionThreshold,
+	}
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"context"
+	"math"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/CeresDB/horaemeta/server/etcdutil"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRetentionInterval = 10 * time.Minute
+	defaultRetentionPageSize = 1000
+
+	retentionElectionPath = "retentionLeader"
+)
+
+var (
+	retentionScannedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "horaemeta_procedure_retention_scanned_total",
+		Help: "Number of soft-deleted procedure records the retention GC has scanned.",
+	})
+	retentionDeletedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "horaemeta_procedure_retention_deleted_total",
+		Help: "Number of soft-deleted procedure records the retention GC has removed from etcd.",
+	})
+	retentionKeptTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "horaemeta_procedure_retention_kept_total",
+		Help: "Number of soft-deleted procedure records the retention GC scanned but kept.",
+	})
+)
+
+// RetentionPolicy controls how long soft-deleted procedures are kept under
+// PathDeletedProcedure before the GC removes them.
+type RetentionPolicy struct {
+	// MaxAge is how long a deleted procedure is kept, measured from its
+	// Meta.UpdatedAt (the deleted copy's own creation time isn't tracked
+	// separately, but MarkDeleted runs immediately after a procedure reaches
+	// its terminal state, so UpdatedAt is a close enough proxy). Zero means
+	// entries are never expired by age.
+	MaxAge time.Duration
+	// MaxAgeByState overrides MaxAge for specific Meta.State values, e.g.
+	// keeping failed procedures around longer than succeeded ones for
+	// post-mortem debugging.
+	MaxAgeByState map[string]time.Duration
+	// MaxEntries caps how many deleted procedures are retained per cluster,
+	// regardless of age; once exceeded, the oldest procedure IDs are trimmed
+	// first. Zero disables the cap.
+	MaxEntries int
+}
+
+func (p RetentionPolicy) maxAgeFor(meta *Meta) time.Duration {
+	if d, ok := p.MaxAgeByState[meta.State]; ok {
+		return d
+	}
+	return p.MaxAge
+}
+
+// Retention is a background GC for the entries MarkDeleted accumulates under
+// PathDeletedProcedure, which nothing else ever removes. Run should be
+// started once per cluster; it guards its GC passes with an etcd election so
+// only one HoraeMeta node performs the scan-and-delete work at a time.
+type Retention struct {
+	client    *clientv3.Client
+	clusterID uint32
+	rootPath  string
+	policy    RetentionPolicy
+
+	interval int64 // nanoseconds so Retention stays comparable/zero-value friendly; see intervalDuration
+	pageSize int
+}
+
+// NewRetention creates a Retention GC for clusterID's deleted procedures.
+// interval controls how often a GC pass is attempted; pass 0 to use
+// defaultRetentionInterval.
+func NewRetention(client *clientv3.Client, rootPath string, clusterID uint32, policy RetentionPolicy, interval time.Duration) *Retention {
+	if interval <= 0 {
+		interval = defaultRetentionInterval
+	}
+	return &Retention{
+		client:    client,
+		clusterID: clusterID,
+		rootPath:  rootPath,
+		policy:    policy,
+		interval:  int64(interval),
+		pageSize:  defaultRetentionPageSize,
+	}
+}
+
+func (r *Retention) intervalDuration() time.Duration {
+	return time.Duration(r.interval)
+}
+
+// Run blocks, attempting a GC pass every interval until ctx is cancelled.
+// Each attempt first tries to become the elected retention leader for this
+// cluster; nodes that don't win the election within half an interval skip
+// that pass rather than blocking further, so a node that's behind doesn't
+// fall further behind waiting on leadership it may never get during this tick.
+func (r *Retention) Run(ctx context.Context) error {
+	session, err := concurrency.NewSession(r.client, concurrency.WithTTL(int(r.intervalDuration().Seconds())))
+	if err != nil {
+		return errors.WithMessage(err, "create retention election session failed")
+	}
+	defer session.Close()
+
+	election := concurrency.NewElection(session, path.Join(r.rootPath, retentionElectionPath, fmtID(uint64(r.clusterID))))
+
+	ticker := time.NewTicker(r.intervalDuration())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			r.runIfLeader(ctx, election)
+		}
+	}
+}
+
+func (r *Retention) runIfLeader(ctx context.Context, election *concurrency.Election) {
+	campaignCtx, cancel := context.WithTimeout(ctx, r.intervalDuration()/2)
+	defer cancel()
+	if err := election.Campaign(campaignCtx, "retention-gc"); err != nil {
+		// Either another node is already leader and held onto it past our
+		// timeout, or ctx was cancelled; either way, skip this pass.
+		return
+	}
+	defer func() {
+		resignCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := election.Resign(resignCtx); err != nil {
+			zap.L().Warn("retention gc failed to resign leadership", zap.Error(err))
+		}
+	}()
+
+	if err := r.runOnce(ctx); err != nil {
+		zap.L().Error("retention gc pass failed", zap.Error(err))
+	}
+}
+
+// runOnce scans every deleted-procedure entry for this cluster (across both
+// the current and legacy storage versions) and removes the ones the policy
+// has expired, then enforces MaxEntries across both versions combined.
+func (r *Retention) runOnce(ctx context.Context) error {
+	for _, version := range []string{Version, LegacyVersion} {
+		if err := r.expireByAge(ctx, version); err != nil {
+			return errors.WithMessagef(err, "expire by age failed, version:%s", version)
+		}
+	}
+	if err := r.enforceMaxEntries(ctx); err != nil {
+		return errors.WithMessage(err, "enforce max entries failed")
+	}
+	return nil
+}
+
+// expireByAge walks the deleted-procedure keyspace in fixed procedureID
+// windows of r.pageSize. Whenever every entry in a window has expired, the
+// whole window is removed with a single ranged delete; otherwise the
+// individual expired entries (if any) are removed together in one
+// transaction, so a partially-expired window never costs more than one
+// extra etcd round-trip over the scan itself.
+func (r *Retention) expireByAge(ctx context.Context, version string) error {
+	now := time.Now()
+
+	for windowStart := uint64(0); ; {
+		windowEnd := windowStart + uint64(r.pageSize)
+		if windowEnd < windowStart {
+			windowEnd = math.MaxUint64 // overflow: this is the last window
+		}
+
+		type entry struct {
+			key     string
+			expired bool
+		}
+		var entries []entry
+
+		startKey := r.deletedKeyPath(windowStart, version)
+		endKey := r.deletedKeyPath(windowEnd, version)
+		err := etcdutil.Scan(ctx, r.client, startKey, endKey, r.pageSize, func(key string, value []byte) error {
+			retentionScannedTotal.Inc()
+			meta, err := decodeMeta(string(value))
+			if err != nil {
+				return errors.WithMessagef(err, "decode deleted meta failed, key:%s", key)
+			}
+			maxAge := r.policy.maxAgeFor(meta)
+			expired := maxAge > 0 && now.Sub(time.Unix(0, meta.UpdatedAt)) >= maxAge
+			entries = append(entries, entry{key: key, expired: expired})
+			return nil
+		})
+		if err != nil {
+			return errors.WithMessage(err, "scan deleted procedure failed")
+		}
+
+		if len(entries) == 0 {
+			if windowEnd == math.MaxUint64 {
+				return nil
+			}
+			// Jump straight to the window holding the next deleted entry, if
+			// any, instead of stepping through every empty window.
+			next, err := r.client.Get(ctx, endKey, clientv3.WithRange(r.deletedKeyPath(math.MaxUint64, version)), clientv3.WithLimit(1), clientv3.WithKeysOnly())
+			if err != nil {
+				return errors.WithMessage(err, "find next deleted procedure failed")
+			}
+			if len(next.Kvs) == 0 {
+				return nil
+			}
+			nextID, err := strconv.ParseUint(path.Base(string(next.Kvs[0].Key)), 10, 64)
+			if err != nil {
+				return errors.WithMessagef(err, "parse deleted procedure id failed, key:%s", next.Kvs[0].Key)
+			}
+			windowStart = nextID - nextID%uint64(r.pageSize)
+			continue
+		}
+
+		allExpired := true
+		var toDelete []string
+		for _, e := range entries {
+			if e.expired {
+				toDelete = append(toDelete, e.key)
+			} else {
+				allExpired = false
+			}
+		}
+
+		switch {
+		case allExpired:
+			if _, err := r.client.Delete(ctx, startKey, clientv3.WithRange(endKey)); err != nil {
+				return errors.WithMessage(err, "delete expired window failed")
+			}
+			retentionDeletedTotal.Add(float64(len(toDelete)))
+		case len(toDelete) > 0:
+			ops := make([]clientv3.Op, 0, len(toDelete))
+			for _, key := range toDelete {
+				ops = append(ops, clientv3.OpDelete(key))
+			}
+			if _, err := r.client.Txn(ctx).Then(ops...).Commit(); err != nil {
+				return errors.WithMessage(err, "delete expired entries failed")
+			}
+			retentionDeletedTotal.Add(float64(len(toDelete)))
+			retentionKeptTotal.Add(float64(len(entries) - len(toDelete)))
+		default:
+			retentionKeptTotal.Add(float64(len(entries)))
+		}
+
+		if windowEnd == math.MaxUint64 {
+			return nil
+		}
+		windowStart = windowEnd
+	}
+}
+
+// enforceMaxEntries trims the oldest deleted procedures once the total count
+// across both storage versions exceeds MaxEntries - counting (and trimming)
+// each version's prefix independently would let a cluster retain up to
+// MaxEntries entries under each prefix, doubling the effective cap.
+//
+// LegacyVersion entries predate the v2 rollout by construction, so they're
+// trimmed first; only once that prefix is exhausted does trimming move on to
+// Version.
+func (r *Retention) enforceMaxEntries(ctx context.Context) error {
+	if r.policy.MaxEntries <= 0 {
+		return nil
+	}
+
+	oldestFirst := []string{LegacyVersion, Version}
+
+	var total int64
+	counts := make(map[string]int64, len(oldestFirst))
+	for _, version := range oldestFirst {
+		startKey := r.deletedKeyPath(0, version)
+		endKey := r.deletedKeyPath(math.MaxUint64, version)
+		resp, err := r.client.Get(ctx, startKey, clientv3.WithRange(endKey), clientv3.WithCountOnly())
+		if err != nil {
+			return errors.WithMessagef(err, "count deleted procedure failed, version:%s", version)
+		}
+		counts[version] = resp.Count
+		total += resp.Count
+	}
+
+	excess := total - int64(r.policy.MaxEntries)
+	for _, version := range oldestFirst {
+		if excess <= 0 {
+			break
+		}
+		trimTarget := excess
+		if trimTarget > counts[version] {
+			trimTarget = counts[version]
+		}
+		if trimTarget <= 0 {
+			continue
+		}
+		trimmed, err := r.trimOldest(ctx, version, trimTarget)
+		if err != nil {
+			return errors.WithMessagef(err, "trim deleted procedure failed, version:%s", version)
+		}
+		excess -= trimmed
+	}
+	return nil
+}
+
+// trimOldest removes the oldest n deleted procedures under version's prefix
+// (oldest by procedureID, which is monotonically assigned and so a
+// reasonable proxy for deletion order) via a single ranged delete, returning
+// how many were actually removed.
+func (r *Retention) trimOldest(ctx context.Context, version string, n int64) (int64, error) {
+	startKey := r.deletedKeyPath(0, version)
+	endKey := r.deletedKeyPath(math.MaxUint64, version)
+
+	cutoffResp, err := r.client.Get(ctx, startKey, clientv3.WithRange(endKey), clientv3.WithLimit(n), clientv3.WithKeysOnly())
+	if err != nil {
+		return 0, errors.WithMessage(err, "find retention cutoff failed")
+	}
+	if len(cutoffResp.Kvs) == 0 {
+		return 0, nil
+	}
+	// Delete [startKey, lastKey], i.e. up to and including the last of the
+	// oldest n keys; OpDeleteRange's end is exclusive, so use the key
+	// immediately after it.
+	cutoffKeyExclusive := string(cutoffResp.Kvs[len(cutoffResp.Kvs)-1].Key) + "\x00"
+
+	if _, err := r.client.Delete(ctx, startKey, clientv3.WithRange(cutoffKeyExclusive)); err != nil {
+		return 0, errors.WithMessage(err, "trim deleted procedure failed")
+	}
+	retentionDeletedTotal.Add(float64(len(cutoffResp.Kvs)))
+	return int64(len(cutoffResp.Kvs)), nil
+}
+
+func (r *Retention) deletedKeyPath(procedureID uint64, version string) string {
+	e := EtcdStorageImpl{client: r.client, clusterID: r.clusterID, rootPath: r.rootPath}
+	return e.generateKeyPath(procedureID, true, version)
+}
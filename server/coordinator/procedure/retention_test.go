@@ -0,0 +1,89 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/tests/v3/integration"
+)
+
+func TestMaxAgeFor(t *testing.T) {
+	policy := RetentionPolicy{
+		MaxAge: time.Hour,
+		MaxAgeByState: map[string]time.Duration{
+			"failed": 24 * time.Hour,
+		},
+	}
+
+	require.Equal(t, time.Hour, policy.maxAgeFor(&Meta{State: "success"}))
+	require.Equal(t, 24*time.Hour, policy.maxAgeFor(&Meta{State: "failed"}))
+}
+
+// TestEnforceMaxEntriesAcrossBothVersions verifies that MaxEntries caps the
+// combined count of deleted procedures across the current and legacy
+// prefixes, trimming the legacy (oldest) prefix first instead of letting
+// each prefix retain up to MaxEntries independently.
+func TestEnforceMaxEntriesAcrossBothVersions(t *testing.T) {
+	integration.BeforeTestExternal(t)
+	cluster := integration.NewClusterV3(t, &integration.ClusterConfig{Size: 1})
+	t.Cleanup(cluster.Terminate)
+
+	client := cluster.RandClient()
+	storage, _, _ := NewEtcdStorageImpl(client, "/horaemeta-test", 1, CompressionNone, 0, RetentionPolicy{}, 0)
+	ctx := context.Background()
+	e := EtcdStorageImpl{client: client, clusterID: 1, rootPath: "/horaemeta-test"}
+
+	// Procedures 1-3 were soft-deleted before the v2 rollout, so their
+	// deleted copies live under the legacy prefix.
+	for id := uint64(1); id <= 3; id++ {
+		body, err := json.Marshal(Meta{ID: id, ClusterID: 1, Typ: "t", State: "success"})
+		require.NoError(t, err)
+		_, err = client.Put(ctx, e.generateKeyPath(id, true, LegacyVersion), string(body))
+		require.NoError(t, err)
+	}
+	for id := uint64(4); id <= 5; id++ {
+		meta := Meta{ID: id, ClusterID: 1, Typ: "t", State: "success"}
+		require.NoError(t, storage.ForceCreateOrUpdate(ctx, meta))
+		require.NoError(t, storage.MarkDeleted(ctx, id))
+	}
+
+	retention := NewRetention(client, "/horaemeta-test", 1, RetentionPolicy{MaxEntries: 2}, time.Minute)
+	require.NoError(t, retention.enforceMaxEntries(ctx))
+
+	remaining, err := storage.List(ctx, 100)
+	require.NoError(t, err)
+	require.Empty(t, remaining, "List only returns live procedures, not soft-deleted ones")
+
+	var deletedCount int
+	counts := make(map[string]int)
+	for _, version := range []string{Version, LegacyVersion} {
+		start := e.generateKeyPath(0, true, version)
+		end := e.generateKeyPath(^uint64(0), true, version)
+		resp, err := client.Get(ctx, start, clientv3.WithRange(end))
+		require.NoError(t, err)
+		counts[version] = len(resp.Kvs)
+		deletedCount += len(resp.Kvs)
+	}
+	require.Equal(t, 2, deletedCount, "MaxEntries should cap the combined deleted count, not each prefix independently")
+	require.Zero(t, counts[LegacyVersion], "the legacy prefix should be trimmed before the current one")
+}
@@ -0,0 +1,36 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import "context"
+
+// Storage persists procedure state. EtcdStorageImpl is the only
+// implementation, backed by etcd.
+type Storage interface {
+	CreateOrUpdate(ctx context.Context, meta Meta) error
+	// ForceCreateOrUpdate inserts meta as a brand new procedure; see
+	// EtcdStorageImpl.ForceCreateOrUpdate for the full contract.
+	ForceCreateOrUpdate(ctx context.Context, meta Meta) error
+	// Get fetches a single procedure's Meta with its ModRevision populated,
+	// suitable for passing back into CreateOrUpdate as a CAS token.
+	Get(ctx context.Context, id uint64) (*Meta, error)
+	MarkDeleted(ctx context.Context, id uint64) error
+	List(ctx context.Context, batchSize int) ([]*Meta, error)
+	// Watch streams procedure state changes; see EtcdStorageImpl.Watch for
+	// the full contract.
+	Watch(ctx context.Context, fromRevision int64) (<-chan Event, error)
+}
@@ -18,126 +18,266 @@ package procedure
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"math"
 	"path"
+	"time"
 
-	"github.com/CeresDB/horaemeta/server/etcdutil"
 	"github.com/pkg/errors"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 const (
-	Version              = "v1"
+	// Version is the storage layout used for keys written by this node.
+	// LegacyVersion is kept readable (and writable in place, see
+	// CreateOrUpdate) so a rolling upgrade doesn't strand procedures that were
+	// created before the bump.
+	Version              = "v2"
+	LegacyVersion        = "v1"
 	PathProcedure        = "procedure"
 	PathDeletedProcedure = "deletedProcedure"
+
+	// defaultCompressionThreshold is the payload size below which compression is
+	// skipped, since the framing overhead isn't worth it for small values.
+	defaultCompressionThreshold = 1024
 )
 
 type EtcdStorageImpl struct {
 	client    *clientv3.Client
 	clusterID uint32
 	rootPath  string
+
+	compression          CompressionType
+	compressionThreshold int
 }
 
-func NewEtcdStorageImpl(client *clientv3.Client, rootPath string, clusterID uint32) Storage {
-	return &EtcdStorageImpl{
-		client:    client,
-		clusterID: clusterID,
-		rootPath:  rootPath,
+// NewEtcdStorageImpl creates a Storage backed by etcd.
+//
+// compression controls the codec used when a payload exceeds
+// compressionThreshold bytes; pass CompressionNone to disable compression
+// entirely. A non-positive compressionThreshold falls back to
+// defaultCompressionThreshold.
+//
+// retentionPolicy configures the background GC for soft-deleted procedures;
+// pass a zero-value RetentionPolicy (the default) to opt out, in which case
+// the returned *Retention is nil and nothing deletes those entries. When a
+// non-zero policy is given, the caller is expected to start the returned
+// Retention's Run method (typically `go retention.Run(ctx)`) once - this
+// constructor only builds it, it doesn't start the background goroutine
+// itself.
+//
+// The returned *MigrationCompactor upgrades any procedures still encoded
+// with the legacy plain-JSON wire format, in place; like Retention, building
+// it doesn't start anything - run it periodically (e.g.
+// `migration.Compact(ctx, batchSize)` from a ticker) to actually reclaim the
+// legacy encoding.
+func NewEtcdStorageImpl(client *clientv3.Client, rootPath string, clusterID uint32, compression CompressionType, compressionThreshold int, retentionPolicy RetentionPolicy, retentionInterval time.Duration) (Storage, *Retention, *MigrationCompactor) {
+	if compressionThreshold <= 0 {
+		compressionThreshold = defaultCompressionThreshold
+	}
+	storage := &EtcdStorageImpl{
+		client:               client,
+		clusterID:            clusterID,
+		rootPath:             rootPath,
+		compression:          compression,
+		compressionThreshold: compressionThreshold,
+	}
+
+	var retention *Retention
+	if retentionPolicy.MaxAge > 0 || retentionPolicy.MaxEntries > 0 || len(retentionPolicy.MaxAgeByState) > 0 {
+		retention = NewRetention(client, rootPath, clusterID, retentionPolicy, retentionInterval)
 	}
+
+	migration := NewMigrationCompactor(client, rootPath, clusterID, compression, compressionThreshold)
+	return storage, retention, migration
 }
 
-// CreateOrUpdate example:
-// /{rootPath}/v1/procedure/{procedureID} -> {procedureType} + {procedureState} + {data}
-func (e EtcdStorageImpl) CreateOrUpdate(ctx context.Context, meta Meta) error {
-	s, err := encode(&meta)
+// resolveKeyPath returns the key a procedure's state should be written to:
+// its existing legacy v1 key if one is present, otherwise the current
+// Version's key for brand new procedures.
+func (e EtcdStorageImpl) resolveKeyPath(ctx context.Context, procedureID uint64) (string, error) {
+	legacyKeyPath := e.generateKeyPath(procedureID, false, LegacyVersion)
+	resp, err := e.client.Get(ctx, legacyKeyPath)
 	if err != nil {
-		return errors.WithMessage(err, "encode meta failed")
+		return "", err
 	}
-	keyPath := e.generaNormalKeyPath(meta.ID)
-	opPut := clientv3.OpPut(keyPath, s)
-
-	if _, err = e.client.Do(ctx, opPut); err != nil {
-		return errors.WithMessage(err, "etcd put data failed")
+	if len(resp.Kvs) > 0 {
+		return legacyKeyPath, nil
 	}
-	return nil
+	return e.generaNormalKeyPath(procedureID), nil
 }
 
 // MarkDeleted Do a soft deletion, and the deleted key's format is:
-// /{rootPath}/v1/historyProcedure/{clusterID}/{procedureID}
+// /{rootPath}/v2/deletedProcedure/{clusterID}/{procedureID}
+//
+// The move is guarded by a compare-and-swap on the live key's mod-revision,
+// so a delete racing against a concurrent state-change write from
+// CreateOrUpdate can't silently drop that write: whichever of the two loses
+// the race gets ErrConcurrentUpdate back instead.
 func (e EtcdStorageImpl) MarkDeleted(ctx context.Context, id uint64) error {
 	keyPath := e.generaNormalKeyPath(id)
-	meta, err := etcdutil.Get(ctx, e.client, keyPath)
+	resp, err := e.client.Get(ctx, keyPath)
 	if err != nil {
 		return errors.WithMessage(err, "get meta failed")
 	}
+	if len(resp.Kvs) == 0 {
+		// The procedure may still be living under its legacy v1 key.
+		keyPath = e.generateKeyPath(id, false, LegacyVersion)
+		resp, err = e.client.Get(ctx, keyPath)
+		if err != nil {
+			return errors.WithMessage(err, "get meta failed")
+		}
+	}
+	if len(resp.Kvs) == 0 {
+		return errors.Errorf("procedure not found, procedureID:%d", id)
+	}
+	kv := resp.Kvs[0]
 
 	deletedKeyPath := e.generaDeletedKeyPath(id)
+	cmp := clientv3.Compare(clientv3.ModRevision(keyPath), "=", kv.ModRevision)
 	opDelete := clientv3.OpDelete(keyPath)
-	opPut := clientv3.OpPut(deletedKeyPath, meta)
+	opPut := clientv3.OpPut(deletedKeyPath, string(kv.Value))
+	opGet := clientv3.OpGet(keyPath)
 
-	_, err = e.client.Txn(ctx).Then(opDelete, opPut).Commit()
+	txnResp, err := e.client.Txn(ctx).If(cmp).Then(opDelete, opPut).Else(opGet).Commit()
+	if err != nil {
+		return errors.WithMessage(err, "etcd txn delete data failed")
+	}
+	if txnResp.Succeeded {
+		return nil
+	}
 
-	return err
+	rangeResp := (*clientv3.GetResponse)(txnResp.Responses[0].GetResponseRange())
+	current, err := decodeConcurrentUpdateCurrent(rangeResp, id)
+	if err != nil {
+		return errors.WithMessage(err, "decode current meta failed")
+	}
+	return &ErrConcurrentUpdate{Current: current}
 }
 
+// List scans both the current Version prefix and the LegacyVersion prefix,
+// so procedures that haven't been touched (and therefore migrated) since
+// before the v2 rollout are still returned.
+//
+// Unlike the other scans in this package, List can't go through
+// etcdutil.Scan: that helper's callback only sees a key/value pair, dropping
+// the mod-revision each entry was read at, and List's results need
+// ModRevision populated so a caller can round-trip one straight back into
+// CreateOrUpdate as a CAS token (the same contract Get provides).
 func (e EtcdStorageImpl) List(ctx context.Context, batchSize int) ([]*Meta, error) {
 	var metas []*Meta
-	do := func(key string, value []byte) error {
-		meta, err := decodeMeta(string(value))
-		if err != nil {
-			return errors.WithMessagef(err, "decode meta failed, key:%s, value:%v", key, value)
-		}
+	for _, version := range []string{Version, LegacyVersion} {
+		endKey := e.generateKeyPath(math.MaxUint64, false, version)
+		cursor := e.generateKeyPath(uint64(0), false, version)
 
-		metas = append(metas, meta)
-		return nil
-	}
+		for {
+			resp, err := e.client.Get(ctx, cursor, clientv3.WithRange(endKey), clientv3.WithLimit(int64(batchSize)))
+			if err != nil {
+				return nil, errors.WithMessage(err, "scan procedure failed")
+			}
 
-	startKey := e.generaNormalKeyPath(uint64(0))
-	endKey := e.generaNormalKeyPath(math.MaxUint64)
+			for _, kv := range resp.Kvs {
+				meta, err := decodeMetaKV(kv)
+				if err != nil {
+					return nil, errors.WithMessagef(err, "decode meta failed, key:%s", kv.Key)
+				}
+				metas = append(metas, meta)
+			}
 
-	err := etcdutil.Scan(ctx, e.client, startKey, endKey, batchSize, do)
-	if err != nil {
-		return nil, errors.WithMessage(err, "scan procedure failed")
+			if int64(len(resp.Kvs)) < int64(batchSize) {
+				break
+			}
+			cursor = string(resp.Kvs[len(resp.Kvs)-1].Key) + "\x00"
+		}
 	}
 	return metas, nil
 }
 
 func (e EtcdStorageImpl) generaNormalKeyPath(procedureID uint64) string {
-	return e.generateKeyPath(procedureID, false)
+	return e.generateKeyPath(procedureID, false, Version)
 }
 
 func (e EtcdStorageImpl) generaDeletedKeyPath(procedureID uint64) string {
-	return e.generateKeyPath(procedureID, true)
+	return e.generateKeyPath(procedureID, true, Version)
 }
 
-func (e EtcdStorageImpl) generateKeyPath(procedureID uint64, isDeleted bool) string {
+func (e EtcdStorageImpl) generateKeyPath(procedureID uint64, isDeleted bool, version string) string {
 	var procedurePath string
 	if isDeleted {
 		procedurePath = PathDeletedProcedure
 	} else {
 		procedurePath = PathProcedure
 	}
-	return path.Join(e.rootPath, Version, procedurePath, fmtID(uint64(e.clusterID)), fmtID(procedureID))
+	return path.Join(e.rootPath, version, procedurePath, fmtID(uint64(e.clusterID)), fmtID(procedureID))
 }
 
 func fmtID(id uint64) string {
 	return fmt.Sprintf("%020d", id)
 }
 
-// TODO: Use proto.Marshal replace json.Marshal
-func encode(meta *Meta) (string, error) {
-	bytes, err := json.Marshal(meta)
+// encodeMeta encodes meta with newestCodec, prefixed with that codec's
+// version byte, and, if the result is at least e.compressionThreshold, frames
+// it behind a 2-byte header (frameMagic, codec-id) and compresses it with
+// e.compression. Payloads below the threshold, or written with
+// CompressionNone, are left as plain versioned bytes so decodeMeta can still
+// tell them apart from framed ones.
+func (e EtcdStorageImpl) encodeMeta(meta *Meta) (string, error) {
+	body, err := newestCodec.Encode(meta)
 	if err != nil {
 		return "", err
 	}
-	return string(bytes), nil
+	payload := make([]byte, 0, len(body)+1)
+	payload = append(payload, newestCodec.Version())
+	payload = append(payload, body...)
+
+	if e.compression == CompressionNone || len(payload) < e.compressionThreshold {
+		return string(payload), nil
+	}
+
+	compressed, err := compress(e.compression, payload)
+	if err != nil {
+		return "", errors.WithMessage(err, "compress meta failed")
+	}
+
+	framed := make([]byte, 0, len(compressed)+2)
+	framed = append(framed, frameMagic, byte(e.compression))
+	framed = append(framed, compressed...)
+	return string(framed), nil
 }
 
-// TODO: Use proto.Unmarshal replace json.unmarshal
+// decodeMeta decodes a value read back from etcd, auto-detecting its
+// encoding generation:
+//   - framed + compressed (frameMagic prefix): decompress, then fall through
+//     to the versioned case below
+//   - versioned (a metaVersion* prefix byte): dispatch to the matching Codec
+//   - legacy plain JSON (no prefix, starts with '{'): the original wire
+//     format, from before Codec versioning existed
+//
+// so keys written by any HoraeMeta version, old or new, keep decoding.
 func decodeMeta(meta string) (*Meta, error) {
-	var m Meta
-	err := json.Unmarshal([]byte(meta), &m)
-	return &m, err
+	raw := []byte(meta)
+	if len(raw) == 0 {
+		return nil, errors.New("empty meta value")
+	}
+
+	if raw[0] == frameMagic {
+		if len(raw) < 2 {
+			return nil, errors.New("truncated framed meta value")
+		}
+		decompressed, err := decompress(CompressionType(raw[1]), raw[2:])
+		if err != nil {
+			return nil, errors.WithMessage(err, "decompress meta failed")
+		}
+		raw = decompressed
+	}
+
+	if raw[0] == '{' {
+		return JSONCodec{}.Decode(raw)
+	}
+
+	codec, err := codecForVersion(raw[0])
+	if err != nil {
+		return nil, errors.WithMessage(err, "decode meta failed")
+	}
+	return codec.Decode(raw[1:])
 }
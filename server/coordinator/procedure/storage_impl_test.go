@@ -0,0 +1,79 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestDecodeMetaLegacyJSON covers values written before Codec versioning
+// existed: plain json.Marshal output with no version byte or frame header.
+func TestDecodeMetaLegacyJSON(t *testing.T) {
+	meta := testMeta()
+	body, err := json.Marshal(meta)
+	require.NoError(t, err)
+
+	decoded, err := decodeMeta(string(body))
+	require.NoError(t, err)
+	require.Equal(t, meta, decoded)
+}
+
+// TestEncodeDecodeMetaRoundTrip covers every generation encodeMeta can
+// produce: versioned JSON and versioned proto, each compressed and
+// uncompressed, exercising decodeMeta's auto-detection of both the frame
+// header and the version byte.
+func TestEncodeDecodeMetaRoundTrip(t *testing.T) {
+	cases := []struct {
+		name        string
+		codec       Codec
+		compression CompressionType
+		threshold   int
+	}{
+		{"json-uncompressed", JSONCodec{}, CompressionNone, defaultCompressionThreshold},
+		{"json-gzip", JSONCodec{}, CompressionGzip, 1},
+		{"json-snappy", JSONCodec{}, CompressionSnappy, 1},
+		{"proto-uncompressed", ProtoCodec{}, CompressionNone, defaultCompressionThreshold},
+		{"proto-gzip", ProtoCodec{}, CompressionGzip, 1},
+		{"proto-snappy", ProtoCodec{}, CompressionSnappy, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			oldNewest := newestCodec
+			newestCodec = c.codec
+			defer func() { newestCodec = oldNewest }()
+
+			e := EtcdStorageImpl{compression: c.compression, compressionThreshold: c.threshold}
+			meta := testMeta()
+
+			encoded, err := e.encodeMeta(meta)
+			require.NoError(t, err)
+
+			decoded, err := decodeMeta(encoded)
+			require.NoError(t, err)
+			require.Equal(t, meta, decoded)
+		})
+	}
+}
+
+func TestDecodeMetaEmptyValue(t *testing.T) {
+	_, err := decodeMeta("")
+	require.Error(t, err)
+}
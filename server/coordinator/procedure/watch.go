@@ -0,0 +1,218 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"context"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+	rpctypes "go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+// EventType describes how a procedure's state changed.
+type EventType int
+
+const (
+	// EventCreated is emitted the first time a procedureID's key is written.
+	EventCreated EventType = iota
+	// EventUpdated is emitted for every subsequent write to that key.
+	EventUpdated
+	// EventMarkedDeleted is emitted when the live key is removed by
+	// MarkDeleted.
+	EventMarkedDeleted
+)
+
+// watchChanBuffer bounds how far a slow consumer can lag behind etcd before
+// Watch starts blocking the underlying clientv3.Watcher's delivery goroutine.
+const watchChanBuffer = 64
+
+// defaultSnapshotBatchSize is the List batch size used when Watch falls back
+// to a snapshot after an etcd compaction.
+const defaultSnapshotBatchSize = 100
+
+// Event is a single procedure state change, as observed by Watch.
+type Event struct {
+	Type EventType
+	// Meta is the decoded procedure state. For EventMarkedDeleted, this is
+	// the last value the deleted key held (etcd's PrevKv), not the deletion
+	// itself, since there's nothing left to decode once the key is gone; it's
+	// nil if the event carries no previous value or that value couldn't be
+	// decoded.
+	Meta *Meta
+	// ModRevision is the etcd mod-revision the event was observed at, safe to
+	// pass back into Watch as fromRevision to resume after a restart.
+	ModRevision int64
+}
+
+// Watch streams procedure state changes starting after fromRevision (pass 0
+// to start from the current revision). The returned channel is closed when
+// ctx is cancelled or an unrecoverable watch error occurs.
+//
+// The stream is at-least-once: if etcd compacts a revision this watch hasn't
+// caught up to yet, Watch falls back to a full List snapshot (delivered as
+// EventCreated for every entry found) and resumes watching from the
+// snapshot's revision, rather than returning an error to the caller.
+func (e EtcdStorageImpl) Watch(ctx context.Context, fromRevision int64) (<-chan Event, error) {
+	out := make(chan Event, watchChanBuffer)
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+	for _, version := range []string{Version, LegacyVersion} {
+		prefix := e.procedurePrefix(version)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Once either prefix's watch stops for good, stop the other one
+			// too, so the returned channel gets closed.
+			defer cancel()
+			e.watchPrefix(ctx, prefix, fromRevision, out)
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	return out, nil
+}
+
+// watchPrefix watches a single version's procedure prefix, restarting the
+// underlying clientv3.Watcher from a fresh List snapshot whenever etcd
+// reports the requested revision has been compacted away.
+func (e EtcdStorageImpl) watchPrefix(ctx context.Context, prefix string, fromRevision int64, out chan<- Event) {
+	rev := fromRevision
+	for {
+		opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithPrevKV()}
+		if rev > 0 {
+			opts = append(opts, clientv3.WithRev(rev+1))
+		}
+
+		compacted, err := e.drainWatch(ctx, prefix, opts, out, &rev)
+		if err != nil {
+			zap.L().Error("procedure watch failed", zap.String("prefix", prefix), zap.Error(err))
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if !compacted {
+			return
+		}
+
+		zap.L().Warn("procedure watch compacted, falling back to a List snapshot", zap.String("prefix", prefix))
+		snapshotRev, err := e.emitSnapshot(ctx, out)
+		if err != nil {
+			zap.L().Error("procedure watch snapshot failed", zap.String("prefix", prefix), zap.Error(err))
+			return
+		}
+		rev = snapshotRev
+	}
+}
+
+// drainWatch forwards events from a single clientv3.Watch call until it's
+// cancelled, fails unrecoverably, or the watched revision has been compacted
+// (in which case it returns compacted=true so the caller can fall back to a
+// snapshot).
+func (e EtcdStorageImpl) drainWatch(ctx context.Context, prefix string, opts []clientv3.OpOption, out chan<- Event, rev *int64) (bool, error) {
+	watchCh := e.client.Watch(ctx, prefix, opts...)
+
+	for resp := range watchCh {
+		if err := resp.Err(); err != nil {
+			if errors.Is(err, rpctypes.ErrCompacted) {
+				return true, nil
+			}
+			return false, err
+		}
+
+		for _, ev := range resp.Events {
+			event, ok := toEvent(ev)
+			if !ok {
+				continue
+			}
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return false, nil
+			}
+		}
+		*rev = resp.Header.Revision
+	}
+	return false, nil
+}
+
+// emitSnapshot lists every live procedure and emits it as EventCreated,
+// returning the revision to resume watching from.
+func (e EtcdStorageImpl) emitSnapshot(ctx context.Context, out chan<- Event) (int64, error) {
+	resp, err := e.client.Get(ctx, e.rootPath, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, errors.WithMessage(err, "get snapshot revision failed")
+	}
+
+	metas, err := e.List(ctx, defaultSnapshotBatchSize)
+	if err != nil {
+		return 0, errors.WithMessage(err, "list procedure snapshot failed")
+	}
+	for _, meta := range metas {
+		select {
+		case out <- Event{Type: EventCreated, Meta: meta, ModRevision: resp.Header.Revision}:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	return resp.Header.Revision, nil
+}
+
+func toEvent(ev *clientv3.Event) (Event, bool) {
+	switch ev.Type {
+	case clientv3.EventTypePut:
+		meta, err := decodeMeta(string(ev.Kv.Value))
+		if err != nil {
+			zap.L().Warn("failed to decode watched procedure", zap.ByteString("key", ev.Kv.Key), zap.Error(err))
+			return Event{}, false
+		}
+		typ := EventUpdated
+		if ev.IsCreate() {
+			typ = EventCreated
+		}
+		return Event{Type: typ, Meta: meta, ModRevision: ev.Kv.ModRevision}, true
+	case clientv3.EventTypeDelete:
+		event := Event{Type: EventMarkedDeleted, ModRevision: ev.Kv.ModRevision}
+		if ev.PrevKv != nil {
+			meta, err := decodeMeta(string(ev.PrevKv.Value))
+			if err != nil {
+				zap.L().Warn("failed to decode deleted procedure's previous value", zap.ByteString("key", ev.Kv.Key), zap.Error(err))
+			} else {
+				event.Meta = meta
+			}
+		}
+		return event, true
+	default:
+		return Event{}, false
+	}
+}
+
+// procedurePrefix returns the etcd prefix covering every procedure ID for
+// this cluster under the given storage version, e.g.
+// /{rootPath}/v2/procedure/{clusterID}/.
+func (e EtcdStorageImpl) procedurePrefix(version string) string {
+	return path.Join(e.rootPath, version, PathProcedure, fmtID(uint64(e.clusterID))) + "/"
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2022 The CeresDB Authors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package procedure
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestToEventCreated(t *testing.T) {
+	meta := testMeta()
+	body, err := json.Marshal(meta)
+	require.NoError(t, err)
+
+	ev := &clientv3.Event{
+		Type: clientv3.EventTypePut,
+		Kv: &mvccpb.KeyValue{
+			Value:          body,
+			ModRevision:    5,
+			CreateRevision: 5,
+		},
+	}
+
+	event, ok := toEvent(ev)
+	require.True(t, ok)
+	require.Equal(t, EventCreated, event.Type)
+	require.Equal(t, meta, event.Meta)
+	require.Equal(t, int64(5), event.ModRevision)
+}
+
+func TestToEventUpdated(t *testing.T) {
+	meta := testMeta()
+	body, err := json.Marshal(meta)
+	require.NoError(t, err)
+
+	ev := &clientv3.Event{
+		Type: clientv3.EventTypePut,
+		Kv: &mvccpb.KeyValue{
+			Value:          body,
+			ModRevision:    9,
+			CreateRevision: 3,
+		},
+	}
+
+	event, ok := toEvent(ev)
+	require.True(t, ok)
+	require.Equal(t, EventUpdated, event.Type)
+	require.Equal(t, int64(9), event.ModRevision)
+}
+
+func TestToEventDeleted(t *testing.T) {
+	meta := testMeta()
+	body, err := json.Marshal(meta)
+	require.NoError(t, err)
+
+	ev := &clientv3.Event{
+		Type:   clientv3.EventTypeDelete,
+		Kv:     &mvccpb.KeyValue{ModRevision: 11},
+		PrevKv: &mvccpb.KeyValue{Value: body},
+	}
+
+	event, ok := toEvent(ev)
+	require.True(t, ok)
+	require.Equal(t, EventMarkedDeleted, event.Type)
+	require.Equal(t, meta, event.Meta)
+	require.Equal(t, int64(11), event.ModRevision)
+}
+
+func TestToEventDeletedWithoutPrevKv(t *testing.T) {
+	ev := &clientv3.Event{
+		Type: clientv3.EventTypeDelete,
+		Kv:   &mvccpb.KeyValue{ModRevision: 11},
+	}
+
+	event, ok := toEvent(ev)
+	require.True(t, ok)
+	require.Equal(t, EventMarkedDeleted, event.Type)
+	require.Nil(t, event.Meta)
+	require.Equal(t, int64(11), event.ModRevision)
+}
+
+func TestToEventUndecodableValueIsSkipped(t *testing.T) {
+	ev := &clientv3.Event{
+		Type: clientv3.EventTypePut,
+		Kv:   &mvccpb.KeyValue{Value: []byte("not valid meta")},
+	}
+
+	_, ok := toEvent(ev)
+	require.False(t, ok)
+}
+
+func TestProcedurePrefix(t *testing.T) {
+	e := EtcdStorageImpl{rootPath: "/horaemeta", clusterID: 3}
+	require.Equal(t, "/horaemeta/v2/procedure/00000000000000000003/", e.procedurePrefix(Version))
+	require.Equal(t, "/horaemeta/v1/procedure/00000000000000000003/", e.procedurePrefix(LegacyVersion))
+}